@@ -0,0 +1,41 @@
+// Command bootnode runs a standalone Kademlia discovery server: a
+// well-known address new Conodes and services can seed their routing
+// table from instead of needing a pre-baked JSON Roster. It never joins
+// an sda overlay itself - it only answers FIND_NODE/PING and keeps its
+// own discover.Table fresh, exactly like any other peer in the DHT.
+package main
+
+import (
+	"flag"
+
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/lib/network/discover"
+	"github.com/dedis/cothority/log"
+	"github.com/dedis/crypto/config"
+)
+
+var listenAddress string
+var debugVisible int
+
+func init() {
+	flag.StringVar(&listenAddress, "address", "0.0.0.0:2000", "address to listen for discovery traffic on")
+	flag.IntVar(&debugVisible, "debug", 1, "verbosity: 0-5")
+}
+
+func main() {
+	flag.Parse()
+	log.SetDebugVisible(debugVisible)
+	logger := log.New("cmd", "bootnode", "address", listenAddress)
+
+	kp := config.NewKeyPair(network.Suite)
+	id := network.NewIdentity(kp.Public, listenAddress)
+
+	srv, err := discover.NewServer(network.Suite, kp.Secret, *id)
+	if err != nil {
+		log.Fatal("Couldn't start discovery server:", err)
+	}
+	defer srv.Close()
+
+	logger.Info("Bootnode listening", "id", id.Id)
+	select {}
+}
@@ -0,0 +1,68 @@
+package network
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dedis/crypto/config"
+	"github.com/satori/go.uuid"
+)
+
+// TestChanHostRoundTrip verifies that a Conn accepted by ChanHost.Listen can
+// Send a reply, not just receive - the pattern negotiateListen/negotiateDTLS
+// already rely on for TCP/UDP. A prior version of Listen never set remote
+// on the accepted ChanConn, so the reply's Send nil-pointer-panicked on
+// c.remote.inbox.
+func TestChanHostRoundTrip(t *testing.T) {
+	registry := &chanRegistry{hosts: make(map[uuid.UUID]*ChanHost)}
+
+	kpA := config.NewKeyPair(Suite)
+	kpB := config.NewKeyPair(Suite)
+	idA := NewIdentity(kpA.Public, "inproc://a")
+	idB := NewIdentity(kpB.Public, "inproc://b")
+
+	hostA := NewChanHost(registry, *idA)
+	hostB := NewChanHost(registry, *idB)
+	defer hostA.Close()
+	defer hostB.Close()
+
+	accepted := make(chan Conn, 1)
+	if err := hostB.Listen("", func(c Conn) { accepted <- c }); err != nil {
+		t.Fatalf("B Listen: %s", err)
+	}
+	if err := hostA.Listen("", func(c Conn) {}); err != nil {
+		t.Fatalf("A Listen: %s", err)
+	}
+
+	connA, err := hostA.Open(idB.First())
+	if err != nil {
+		t.Fatalf("Open: %s", err)
+	}
+	if err := connA.Send(context.TODO(), idA); err != nil {
+		t.Fatalf("Send: %s", err)
+	}
+
+	var connB Conn
+	select {
+	case connB = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatalf("B never accepted a connection from A")
+	}
+
+	if err := connB.Send(context.TODO(), idB); err != nil {
+		t.Fatalf("reply Send: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	am, err := connA.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive: %s", err)
+	}
+	got, ok := am.Msg.(Identity)
+	if !ok || got.Id != idB.Id {
+		t.Fatalf("A did not receive B's reply")
+	}
+}
@@ -0,0 +1,51 @@
+package network
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// CounterIO is implemented by anything that can report how many bytes it has
+// moved so far. TcpConn implements it so
+// monitor.CounterIOMeasure has an exact byte count to report instead of
+// estimating from message sizes.
+type CounterIO interface {
+	Rx() uint64
+	Tx() uint64
+}
+
+// counterReader wraps an io.Reader and atomically accumulates every byte
+// read into a counter, so it can be read concurrently with Rx().
+type counterReader struct {
+	io.Reader
+	count uint64
+}
+
+func (c *counterReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	atomic.AddUint64(&c.count, uint64(n))
+	return n, err
+}
+
+// counterWriter wraps an io.Writer the same way counterReader wraps a
+// reader.
+type counterWriter struct {
+	io.Writer
+	count uint64
+}
+
+func (c *counterWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	atomic.AddUint64(&c.count, uint64(n))
+	return n, err
+}
+
+// Rx returns the total number of bytes this TcpConn has received so far.
+func (c *TcpConn) Rx() uint64 {
+	return atomic.LoadUint64(&c.rx.count)
+}
+
+// Tx returns the total number of bytes this TcpConn has sent so far.
+func (c *TcpConn) Tx() uint64 {
+	return atomic.LoadUint64(&c.tx.count)
+}
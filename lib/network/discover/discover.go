@@ -0,0 +1,27 @@
+// Package discover implements a Kademlia-style, XOR-metric peer discovery
+// table over UDP, keyed by the same network.Identity.Id (a UUIDv5 of the
+// identity's public key) already used everywhere else in cothority.
+//
+// Real-world deployments of cothority services can't always rely on a
+// pre-baked Roster: sda.LoadSimulationConfig and SecureTcpHost.Open both
+// assume every Identity.Addresses was known ahead of time. A Server here
+// answers FIND_NODE and PING requests from other peers, keeps a local
+// Table fresh as replies come in, and exposes Lookup so a caller can build
+// a live Roster from a handful of bootnodes instead of a static file.
+//
+// This package only covers the discovery wire protocol and routing table.
+// Wiring a live Table into sda.Roster (a NewDynamicRoster constructor that
+// periodically refreshes membership) belongs in the sda package, which
+// isn't part of this tree snapshot, so it isn't implemented here.
+package discover
+
+// k is the maximum number of entries held in a single k-bucket, and the
+// number of identities Table.Lookup returns - the standard Kademlia
+// replication parameter.
+const k = 16
+
+// numBuckets matches the 128 bits of a UUIDv5 Identity.Id: bucket i holds
+// every known peer whose XOR distance from the local Id has its highest
+// set bit at position i, so bucket 0 is the closest possible peers and
+// numBuckets-1 the farthest.
+const numBuckets = 128
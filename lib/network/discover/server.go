@@ -0,0 +1,338 @@
+package discover
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/lib/network"
+	"github.com/dedis/cothority/log"
+	"github.com/dedis/crypto/abstract"
+	"github.com/satori/go.uuid"
+)
+
+// pingTimeout bounds how long Server waits for a PONG or FIND_NODE reply
+// before treating the peer as unreachable.
+const pingTimeout = 2 * time.Second
+
+// messageKind tags every datagram the discovery wire protocol exchanges.
+type messageKind byte
+
+const (
+	kindFindNode messageKind = iota
+	kindFindNodeReply
+	kindPing
+	kindPong
+)
+
+// envelope is what actually travels on the wire: a kind tag, the sender's
+// Identity (so a reply can be addressed and the signature checked against
+// the right public key) and the gob-encoded payload. The signature covers
+// the kind tag and the payload only; the Sender's addresses are not signed.
+type envelope struct {
+	Kind    messageKind
+	Sender  network.IdentityToml
+	Payload []byte
+	SigR    []byte
+	SigS    []byte
+}
+
+type findNodePayload struct {
+	Target uuid.UUID
+}
+
+type findNodeReplyPayload struct {
+	Closest []network.IdentityToml
+}
+
+type pingPayload struct{}
+
+type pongPayload struct{}
+
+// Server runs the Kademlia-style UDP discovery protocol for one local
+// Identity: it answers FIND_NODE/PING from peers, keeps its own Table
+// fresh as replies come in, and lets a caller build a live Roster from a
+// handful of bootnodes instead of a pre-baked JSON config.
+type Server struct {
+	local   network.Identity
+	private abstract.Secret
+	suite   abstract.Suite
+	table   *Table
+	conn    net.PacketConn
+	logger  *log.Logger
+
+	pendingMut sync.Mutex
+	// pending holds the reply channel for the one discovery request
+	// currently in flight to a given address. Good enough for the
+	// request-at-a-time pattern Bootstrap/offer use; a second concurrent
+	// request to the same peer would steal the first one's reply.
+	pending map[string]chan envelope
+
+	quit chan struct{}
+}
+
+// NewServer opens a UDP socket on local's first advertised address and
+// starts answering discovery traffic. suite and private are used to sign
+// outgoing messages and verify incoming ones against the sender's claimed
+// public key.
+func NewServer(suite abstract.Suite, private abstract.Secret, local network.Identity) (*Server, error) {
+	pc, err := net.ListenPacket("udp", local.First())
+	if err != nil {
+		return nil, fmt.Errorf("discover: could not open udp socket on %s: %s", local.First(), err)
+	}
+	s := &Server{
+		local:   local,
+		private: private,
+		suite:   suite,
+		table:   NewTable(local.Id),
+		conn:    pc,
+		logger:  log.New("pkg", "discover", "id", local.Id),
+		pending: make(map[string]chan envelope),
+		quit:    make(chan struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Close stops answering discovery traffic and releases the socket.
+func (s *Server) Close() error {
+	close(s.quit)
+	return s.conn.Close()
+}
+
+// Lookup returns the k identities the local Table currently holds that are
+// closest to target. It only reads local state - the FIND_NODE replies
+// handled by serve() in the background are what keeps the Table fresh.
+func (s *Server) Lookup(target uuid.UUID) []network.Identity {
+	return s.table.Lookup(target)
+}
+
+// Bootstrap seeds the Table with bootnodes and runs one FIND_NODE lookup
+// for our own Id against each of them, the standard way a freshly started
+// Kademlia node populates its table from a handful of known peers.
+func (s *Server) Bootstrap(bootnodes []network.Identity) {
+	for _, b := range bootnodes {
+		s.table.Insert(b)
+		closest, err := s.findNode(b, s.local.Id)
+		if err != nil {
+			s.logger.Debug("Bootnode didn't answer FIND_NODE", "bootnode", b.Id, "err", err)
+			continue
+		}
+		for _, id := range closest {
+			s.offer(id)
+		}
+	}
+}
+
+// offer tries to insert id into the Table, running the liveness PING
+// needed to evict a full bucket's oldest entry if there's no room.
+func (s *Server) offer(id network.Identity) {
+	if id.Id == s.local.Id {
+		return
+	}
+	stale, full := s.table.Stale(id.Id)
+	if !full {
+		s.table.Insert(id)
+		return
+	}
+	if s.ping(stale) {
+		// the existing entry answered - keep it, drop id
+		s.table.Insert(stale)
+		return
+	}
+	s.table.Evict(stale.Id, id)
+}
+
+// findNode sends a FIND_NODE to "to" asking for its closest known
+// identities to target, and blocks until it replies or pingTimeout elapses.
+func (s *Server) findNode(to network.Identity, target uuid.UUID) ([]network.Identity, error) {
+	ch := s.awaitReply(to)
+	defer s.cancelReply(to)
+	if err := s.send(kindFindNode, to, findNodePayload{Target: target}); err != nil {
+		return nil, err
+	}
+	select {
+	case env := <-ch:
+		var rep findNodeReplyPayload
+		if err := gob.NewDecoder(bytes.NewReader(env.Payload)).Decode(&rep); err != nil {
+			return nil, fmt.Errorf("discover: decoding FIND_NODE reply: %s", err)
+		}
+		out := make([]network.Identity, 0, len(rep.Closest))
+		for _, t := range rep.Closest {
+			out = append(out, tomlToIdentity(t, s.suite))
+		}
+		return out, nil
+	case <-time.After(pingTimeout):
+		return nil, fmt.Errorf("discover: FIND_NODE to %s timed out", to.First())
+	}
+}
+
+// ping sends a PING to id and reports whether it answered with a PONG
+// before pingTimeout - the liveness check that guards k-bucket eviction.
+func (s *Server) ping(id network.Identity) bool {
+	ch := s.awaitReply(id)
+	defer s.cancelReply(id)
+	if err := s.send(kindPing, id, pingPayload{}); err != nil {
+		return false
+	}
+	select {
+	case <-ch:
+		return true
+	case <-time.After(pingTimeout):
+		return false
+	}
+}
+
+func (s *Server) awaitReply(to network.Identity) chan envelope {
+	ch := make(chan envelope, 1)
+	s.pendingMut.Lock()
+	s.pending[to.First()] = ch
+	s.pendingMut.Unlock()
+	return ch
+}
+
+func (s *Server) cancelReply(to network.Identity) {
+	s.pendingMut.Lock()
+	delete(s.pending, to.First())
+	s.pendingMut.Unlock()
+}
+
+// send signs kind+payload under s.private and writes the resulting
+// envelope to to's first advertised address.
+func (s *Server) send(kind messageKind, to network.Identity, payload interface{}) error {
+	var payloadBuf bytes.Buffer
+	if err := gob.NewEncoder(&payloadBuf).Encode(payload); err != nil {
+		return fmt.Errorf("discover: encoding payload: %s", err)
+	}
+
+	msg := append([]byte{byte(kind)}, payloadBuf.Bytes()...)
+	sig := sign(s.suite, s.private, msg)
+	sigR, err := sig.R.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("discover: marshalling signature: %s", err)
+	}
+	sigS, err := sig.S.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("discover: marshalling signature: %s", err)
+	}
+
+	env := envelope{
+		Kind:    kind,
+		Sender:  *s.local.Toml(s.suite),
+		Payload: payloadBuf.Bytes(),
+		SigR:    sigR,
+		SigS:    sigS,
+	}
+	var out bytes.Buffer
+	if err := gob.NewEncoder(&out).Encode(env); err != nil {
+		return fmt.Errorf("discover: encoding envelope: %s", err)
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", to.First())
+	if err != nil {
+		return fmt.Errorf("discover: resolving %s: %s", to.First(), err)
+	}
+	_, err = s.conn.WriteTo(out.Bytes(), addr)
+	return err
+}
+
+// verifyEnvelope checks env's signature against its claimed sender and, if
+// it holds up, returns that sender's Identity.
+func (s *Server) verifyEnvelope(env envelope) (network.Identity, bool) {
+	sender := tomlToIdentity(env.Sender, s.suite)
+
+	sig := signature{R: s.suite.Point(), S: s.suite.Secret()}
+	if err := sig.R.UnmarshalBinary(env.SigR); err != nil {
+		return network.Identity{}, false
+	}
+	if err := sig.S.UnmarshalBinary(env.SigS); err != nil {
+		return network.Identity{}, false
+	}
+
+	msg := append([]byte{byte(env.Kind)}, env.Payload...)
+	if !verify(s.suite, sender.Public, msg, sig) {
+		return network.Identity{}, false
+	}
+	return sender, true
+}
+
+// tomlToIdentity rebuilds a full network.Identity, Id included, from the
+// wire representation - network.IdentityToml.Identity alone leaves Id
+// unset, so we run it back through NewIdentity the same way the rest of
+// the codebase derives an Id from a public key.
+func tomlToIdentity(t network.IdentityToml, suite abstract.Suite) network.Identity {
+	raw := t.Identity(suite)
+	return *network.NewIdentity(raw.Public, raw.Addresses...)
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 8192)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.quit:
+				return
+			default:
+			}
+			continue
+		}
+		var env envelope
+		if err := gob.NewDecoder(bytes.NewReader(buf[:n])).Decode(&env); err != nil {
+			s.logger.Debug("Dropping malformed discovery packet", "from", addr)
+			continue
+		}
+		s.handle(env)
+	}
+}
+
+func (s *Server) handle(env envelope) {
+	sender, ok := s.verifyEnvelope(env)
+	if !ok {
+		s.logger.Debug("Dropping discovery packet with invalid signature", "from", env.Sender.Addresses)
+		return
+	}
+
+	switch env.Kind {
+	case kindFindNode:
+		s.handleFindNode(env, sender)
+	case kindPing:
+		s.handlePing(sender)
+	case kindFindNodeReply, kindPong:
+		s.pendingMut.Lock()
+		ch, ok := s.pending[sender.First()]
+		s.pendingMut.Unlock()
+		if ok {
+			select {
+			case ch <- env:
+			default:
+			}
+		}
+	}
+	s.table.Insert(sender)
+}
+
+func (s *Server) handleFindNode(env envelope, sender network.Identity) {
+	var req findNodePayload
+	if err := gob.NewDecoder(bytes.NewReader(env.Payload)).Decode(&req); err != nil {
+		s.logger.Debug("Dropping malformed FIND_NODE", "from", sender.Id, "err", err)
+		return
+	}
+	closest := s.table.Lookup(req.Target)
+	toml := make([]network.IdentityToml, len(closest))
+	for i, id := range closest {
+		toml[i] = *id.Toml(s.suite)
+	}
+	if err := s.send(kindFindNodeReply, sender, findNodeReplyPayload{Closest: toml}); err != nil {
+		s.logger.Debug("Couldn't reply to FIND_NODE", "to", sender.Id, "err", err)
+	}
+}
+
+func (s *Server) handlePing(sender network.Identity) {
+	if err := s.send(kindPong, sender, pongPayload{}); err != nil {
+		s.logger.Debug("Couldn't reply to PING", "to", sender.Id, "err", err)
+	}
+}
@@ -0,0 +1,43 @@
+package discover
+
+import (
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/random"
+)
+
+// signature is a minimal Schnorr proof of possession over a message: R is
+// the commitment point, S the response scalar. It is enough to prove a
+// FIND_NODE or PONG really came from the holder of the claimed Identity's
+// private key, without requiring a prior handshake the way SecureTcpHost's
+// negotiateListen does.
+type signature struct {
+	R abstract.Point
+	S abstract.Secret
+}
+
+// sign produces a signature over msg under private, using suite for every
+// group and hash operation.
+func sign(suite abstract.Suite, private abstract.Secret, msg []byte) signature {
+	v := suite.Secret().Pick(random.Stream)
+	R := suite.Point().Mul(nil, v)
+
+	h := suite.Hash()
+	h.Write(R.Bytes())
+	h.Write(msg)
+	e := suite.Secret().Pick(suite.Cipher(h.Sum(nil)))
+
+	s := suite.Secret().Add(v, suite.Secret().Mul(e, private))
+	return signature{R: R, S: s}
+}
+
+// verify reports whether sig is a valid signature over msg under public.
+func verify(suite abstract.Suite, public abstract.Point, msg []byte, sig signature) bool {
+	h := suite.Hash()
+	h.Write(sig.R.Bytes())
+	h.Write(msg)
+	e := suite.Secret().Pick(suite.Cipher(h.Sum(nil)))
+
+	left := suite.Point().Mul(nil, sig.S)
+	right := suite.Point().Add(sig.R, suite.Point().Mul(public, e))
+	return left.Equal(right)
+}
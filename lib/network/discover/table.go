@@ -0,0 +1,199 @@
+package discover
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dedis/cothority/lib/network"
+	"github.com/satori/go.uuid"
+)
+
+// peerEntry is one known peer in a k-bucket: its Identity plus when it was
+// last confirmed alive, so a full bucket can tell its least-recently-seen
+// entry from its most-recently-seen one.
+type peerEntry struct {
+	id       network.Identity
+	lastSeen time.Time
+}
+
+// kbucket holds up to k entries ordered from least- to most-recently-seen
+// (index 0 is the oldest), mirroring Kademlia's bias towards keeping old,
+// proven peers over new, unverified ones.
+type kbucket struct {
+	entries []*peerEntry
+}
+
+// find returns the entry for id, or nil if the bucket doesn't hold it.
+func (b *kbucket) find(id uuid.UUID) *peerEntry {
+	for _, e := range b.entries {
+		if e.id.Id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// touch moves id to the most-recently-seen end of the bucket and reports
+// whether it was found. It does nothing to the bucket's length.
+func (b *kbucket) touch(id uuid.UUID) bool {
+	for i, e := range b.entries {
+		if e.id.Id == id {
+			e.lastSeen = time.Now()
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			b.entries = append(b.entries, e)
+			return true
+		}
+	}
+	return false
+}
+
+// full reports whether the bucket has reached its capacity of k entries.
+func (b *kbucket) full() bool {
+	return len(b.entries) >= k
+}
+
+// oldest returns the least-recently-seen entry, the one a liveness PING
+// must fail before a new peer is allowed to evict it.
+func (b *kbucket) oldest() *peerEntry {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	return b.entries[0]
+}
+
+// add appends a brand new entry at the most-recently-seen end.
+func (b *kbucket) add(id network.Identity) {
+	b.entries = append(b.entries, &peerEntry{id: id, lastSeen: time.Now()})
+}
+
+// evict drops id from the bucket, if present.
+func (b *kbucket) evict(id uuid.UUID) {
+	for i, e := range b.entries {
+		if e.id.Id == id {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// Table is a Kademlia routing table keyed by the XOR distance to a local
+// Identity.Id. It is safe for concurrent use.
+type Table struct {
+	mut     sync.Mutex
+	local   uuid.UUID
+	buckets [numBuckets]kbucket
+}
+
+// NewTable returns an empty Table centered on local.
+func NewTable(local uuid.UUID) *Table {
+	return &Table{local: local}
+}
+
+// Insert records that id answered a discovery message. If id's bucket is
+// already full, Insert leaves the bucket untouched - the caller must go
+// through Stale/Evict to make room, which gives the existing entry a
+// chance to prove it's still alive before being dropped.
+func (t *Table) Insert(id network.Identity) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	b := &t.buckets[bucketIndex(t.local, id.Id)]
+	if b.touch(id.Id) {
+		return
+	}
+	if !b.full() {
+		b.add(id)
+	}
+}
+
+// Stale returns the least-recently-seen peer in the bucket that would hold
+// id, so the caller can PING it before deciding whether to evict it in
+// favor of id. ok is false if that bucket isn't actually full, meaning id
+// can just be inserted directly.
+func (t *Table) Stale(id uuid.UUID) (candidate network.Identity, ok bool) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	b := &t.buckets[bucketIndex(t.local, id)]
+	if !b.full() {
+		return network.Identity{}, false
+	}
+	return b.oldest().id, true
+}
+
+// Evict drops dead from its bucket and adds replacement at the bucket's
+// most-recently-seen end. It is a no-op if dead isn't actually in replacement's bucket.
+func (t *Table) Evict(dead uuid.UUID, replacement network.Identity) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	b := &t.buckets[bucketIndex(t.local, replacement.Id)]
+	if b.find(dead) == nil {
+		return
+	}
+	b.evict(dead)
+	b.add(replacement)
+}
+
+// Lookup returns the k known identities closest to target by XOR distance,
+// the primitive that lets a protocol be launched against a live set of
+// peers instead of a pre-baked Roster.
+func (t *Table) Lookup(target uuid.UUID) []network.Identity {
+	t.mut.Lock()
+	var all []network.Identity
+	for i := range t.buckets {
+		for _, e := range t.buckets[i].entries {
+			all = append(all, e.id)
+		}
+	}
+	t.mut.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return less(xorDistance(target, all[i].Id), xorDistance(target, all[j].Id))
+	})
+	if len(all) > k {
+		all = all[:k]
+	}
+	return all
+}
+
+// xorDistance returns the bytewise XOR of two UUIDs, the Kademlia distance
+// metric.
+func xorDistance(a, b uuid.UUID) [16]byte {
+	var d [16]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// less reports whether distance a is smaller than b when compared as a
+// 128-bit big-endian number.
+func less(a, b [16]byte) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// bucketIndex returns which k-bucket (0..numBuckets-1) a peer at XOR
+// distance xorDistance(local, remote) falls into: the position of the
+// highest set bit, counting from the least significant bit of byte 15, so
+// 0 is the closest bucket and numBuckets-1 the farthest.
+func bucketIndex(local, remote uuid.UUID) int {
+	d := xorDistance(local, remote)
+	for byteIdx, bt := range d {
+		if bt == 0 {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			if bt&(0x80>>uint(bit)) != 0 {
+				msbPos := byteIdx*8 + bit
+				return numBuckets - 1 - msbPos
+			}
+		}
+	}
+	// local == remote: shouldn't normally be looked up, park it in the
+	// closest bucket rather than panicking.
+	return 0
+}
@@ -0,0 +1,94 @@
+package discover
+
+import (
+	"testing"
+
+	"github.com/dedis/cothority/lib/network"
+	"github.com/satori/go.uuid"
+)
+
+// identityWithID returns a minimal Identity whose Id is exactly id, so tests
+// can place peers at a chosen XOR distance from the local Table without
+// generating real key pairs.
+func identityWithID(id uuid.UUID) network.Identity {
+	return network.Identity{Id: id}
+}
+
+func TestTableInsertAndLookup(t *testing.T) {
+	local := uuid.NewV4()
+	table := NewTable(local)
+
+	var want []network.Identity
+	for i := 0; i < k; i++ {
+		id := identityWithID(uuid.NewV4())
+		table.Insert(id)
+		want = append(want, id)
+	}
+
+	got := table.Lookup(local)
+	if len(got) != k {
+		t.Fatalf("expected Lookup to return %d identities, got %d", k, len(got))
+	}
+	for _, id := range want {
+		found := false
+		for _, g := range got {
+			if g.Id == id.Id {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("Lookup result is missing inserted identity %s", id.Id)
+		}
+	}
+}
+
+func TestTableStaleAndEvict(t *testing.T) {
+	local := uuid.NewV4()
+	table := NewTable(local)
+
+	// fill the farthest bucket (XOR distance with its top bit set, which
+	// about half of all random Ids fall into) up to capacity so the next
+	// insert is rejected.
+	target := numBuckets - 1
+	ids := make([]network.Identity, 0, k)
+	for len(ids) < k {
+		id := identityWithID(uuid.NewV4())
+		if bucketIndex(local, id.Id) != target {
+			continue
+		}
+		table.Insert(id)
+		ids = append(ids, id)
+	}
+
+	overflow := identityWithID(uuid.NewV4())
+	for bucketIndex(local, overflow.Id) != target {
+		overflow = identityWithID(uuid.NewV4())
+	}
+	table.Insert(overflow)
+	if got := table.Lookup(local); len(got) != k {
+		t.Fatalf("bucket should still be full at capacity %d, got %d", k, len(got))
+	}
+
+	stale, ok := table.Stale(overflow.Id)
+	if !ok {
+		t.Fatalf("expected Stale to report the full bucket")
+	}
+	if stale.Id != ids[0].Id {
+		t.Fatalf("expected the least-recently-seen entry to be offered for eviction")
+	}
+
+	table.Evict(stale.Id, overflow)
+	found := false
+	for _, g := range table.Lookup(local) {
+		if g.Id == overflow.Id {
+			found = true
+		}
+		if g.Id == stale.Id {
+			t.Fatalf("evicted identity %s is still present after Evict", stale.Id)
+		}
+	}
+	if !found {
+		t.Fatalf("replacement identity %s was not inserted by Evict", overflow.Id)
+	}
+}
@@ -15,16 +15,19 @@ package network
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/dedis/cothority/lib/cliutils"
+	"github.com/dedis/cothority/log"
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/protobuf"
 	"github.com/satori/go.uuid"
@@ -32,6 +35,11 @@ import (
 
 // Network part //
 
+// pkgLogger is the root of every logger this package derives, so a simul run
+// can tell network-layer records apart from sda/simul ones even when
+// everything is tailed together.
+var pkgLogger = log.New("pkg", "network")
+
 // How many times should we try to connect
 const maxRetry = 10
 const waitRetry = 1 * time.Second
@@ -72,8 +80,12 @@ type Conn interface {
 type TcpHost struct {
 	// A list of connection maintained by this host
 	peers map[string]Conn
-	// its listeners
-	listener net.Listener
+	// peersMut guards peers and listeners: bind starts one accept
+	// goroutine per bound address, so with more than one listener
+	// (exactly what Listen now does) they write to peers concurrently.
+	peersMut sync.Mutex
+	// its listeners, one per bound address
+	listeners []net.Listener
 	// the close channel used to indicate to the listener we want to quit
 	quit chan bool
 	// indicates wether this host is closed already or not
@@ -100,7 +112,9 @@ func (t *TcpHost) Open(name string) (Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	t.peersMut.Lock()
 	t.peers[name] = c
+	t.peersMut.Unlock()
 	return c, nil
 }
 
@@ -121,13 +135,7 @@ func (t *TcpHost) openTcpConn(name string) (*TcpConn, error) {
 	if conn == nil {
 		return nil, fmt.Errorf("Could not connect to %s.", name)
 	}
-	c := TcpConn{
-		Endpoint: name,
-		Conn:     conn,
-		host:     t,
-	}
-
-	return &c, err
+	return newTcpConn(name, conn, t), nil
 }
 
 // Listen for any host trying to contact him.
@@ -141,33 +149,58 @@ func (t *TcpHost) Listen(addr string, fn func(Conn)) error {
 
 // listen is the private function that takes a function taht takes a TcpConn.
 // That way we can control what to do of the TcpConn before returning it to the
-// function given by the user. Used by SecureTcpHost
+// function given by the user. Used by SecureTcpHost.
+// It binds a single address and blocks until the host is closed. For hosts
+// that need to listen on more than one address, use bind directly and block
+// on t.quit once every address has been bound (see SecureTcpHost.Listen).
 func (t *TcpHost) listen(addr string, fn func(*TcpConn)) error {
+	if err := t.bind(addr, fn); err != nil {
+		return err
+	}
+	<-t.quit
+	return nil
+}
+
+// bind opens a listener on addr and starts accepting connections on it in a
+// separate goroutine, without blocking the caller. Every listener opened
+// this way feeds the same t.peers map and is torn down together by Close,
+// which lets a host advertising several addresses (e.g. an IPv4 and an IPv6
+// endpoint) accept on all of them concurrently instead of only the first.
+func (t *TcpHost) bind(addr string, fn func(*TcpConn)) error {
 	global, _ := cliutils.GlobalBind(addr)
 	ln, err := net.Listen("tcp", global)
 	if err != nil {
 		return fmt.Errorf("Error opening listener on address %s", addr)
 	}
-	t.listener = ln
+	t.peersMut.Lock()
+	t.listeners = append(t.listeners, ln)
+	t.peersMut.Unlock()
+	pkgLogger.Debug("Listening", "addr", addr)
+	go t.accept(ln, fn)
+	return nil
+}
+
+// accept runs the Accept loop for a single listener, dispatching every
+// incoming connection to fn until the listener is closed. bind starts one
+// of these per bound address, so they run concurrently and must not write
+// to peers without holding peersMut.
+func (t *TcpHost) accept(ln net.Listener, fn func(*TcpConn)) {
 	for {
-		conn, err := t.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			select {
 			case <-t.quit:
-				return nil
+				return
 			default:
 			}
 			continue
 		}
-		c := TcpConn{
-			Endpoint: conn.RemoteAddr().String(),
-			Conn:     conn,
-			host:     t,
-		}
-		t.peers[conn.RemoteAddr().String()] = &c
-		fn(&c)
+		c := newTcpConn(conn.RemoteAddr().String(), conn, t)
+		t.peersMut.Lock()
+		t.peers[conn.RemoteAddr().String()] = c
+		t.peersMut.Unlock()
+		fn(c)
 	}
-	return nil
 }
 
 // Close will close every connection this host has opened
@@ -176,14 +209,20 @@ func (t *TcpHost) Close() error {
 		return nil
 	}
 	t.closed = true
+	// signal quit before closing the listeners, so the accept goroutines
+	// see <-t.quit instead of racing the error returned by a closed Accept
+	close(t.quit)
+	t.peersMut.Lock()
+	defer t.peersMut.Unlock()
 	for _, c := range t.peers {
 		if err := c.Close(); err != nil {
 			return handleError(err)
 		}
 	}
-	close(t.quit)
-	if t.listener != nil {
-		return t.listener.Close()
+	for _, ln := range t.listeners {
+		if err := ln.Close(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -201,6 +240,29 @@ type TcpConn struct {
 	closed bool
 	// A pointer to the associated host (just-in-case)
 	host *TcpHost
+
+	// rx/tx wrap Conn and count exactly how many bytes went through
+	// Receive/Send, so monitor.CounterIOMeasure can report real bandwidth
+	// instead of estimating it from message sizes.
+	rx *counterReader
+	tx *counterWriter
+
+	// logger is keyed with this conn's remote address, so tailing a
+	// simulation's JSON logs and grepping by "remote" isolates one peer.
+	logger *log.Logger
+}
+
+// newTcpConn wraps conn's read and write sides in byte counters and returns
+// a ready-to-use TcpConn.
+func newTcpConn(endpoint string, conn net.Conn, host *TcpHost) *TcpConn {
+	return &TcpConn{
+		Endpoint: endpoint,
+		Conn:     conn,
+		host:     host,
+		rx:       &counterReader{Reader: conn},
+		tx:       &counterWriter{Writer: conn},
+		logger:   pkgLogger.New("remote", endpoint),
+	}
 }
 
 // PeerName returns the name of the peer at the end point of
@@ -233,43 +295,119 @@ func handleError(err error) error {
 	return ErrUnknown
 }
 
+// lengthHeaderSize is the size in bytes of the big-endian length prefix put
+// in front of every marshalled ApplicationMessage on the wire, once
+// wireVersion is wireVersionLengthPrefixed.
+const lengthHeaderSize = 4
+
+// maxMessageSize bounds how big a single incoming message is allowed to be,
+// so a hostile or buggy peer can't make us allocate an unbounded buffer by
+// lying about the length prefix.
+var maxMessageSize uint32 = 512 * 1024 * 1024
+
+// wire version constants for SetWireVersion. wireVersionRaw reproduces the
+// old, broken framing (read until short read) for one release so mixed
+// testbeds keep talking to each other during the migration; new code should
+// never need to set this.
+const (
+	wireVersionLengthPrefixed = iota
+	wireVersionRaw
+)
+
+// wireVersion is the framing every TcpConn uses. It defaults to the new,
+// correct length-prefixed framing.
+var wireVersion = wireVersionLengthPrefixed
+
+// SetWireVersion switches every TcpConn between the length-prefixed framing
+// and the legacy raw, short-read-terminated framing. It exists purely so a
+// mixed-version testbed can be rolled forward without all Conodes being
+// upgraded at once; new deployments should never call this.
+func SetWireVersion(raw bool) {
+	if raw {
+		wireVersion = wireVersionRaw
+	} else {
+		wireVersion = wireVersionLengthPrefixed
+	}
+}
+
+// SetMaxMessageSize changes the cap on incoming message size enforced by
+// Receive. It exists mostly for tests.
+func SetMaxMessageSize(max uint32) {
+	maxMessageSize = max
+}
+
 // Receive waits for any input on the connection and returns
 // the ApplicationMessage **decoded** and an error if something
 // wrong occured
 func (c *TcpConn) Receive(ctx context.Context) (ApplicationMessage, error) {
+	var buffer []byte
+	var err error
+	if wireVersion == wireVersionRaw {
+		buffer, err = c.receiveRaw()
+	} else {
+		buffer, err = c.receiveLengthPrefixed()
+	}
+	if err != nil {
+		return EmptyApplicationMessage, err
+	}
 
 	var am ApplicationMessage
 	am.Constructors = c.host.constructors
+	defer func() {
+		if e := recover(); e != nil {
+			c.logger.Error("Error unmarshalling", "type", am.MsgType, "bytes", len(buffer), "panic", e)
+		}
+	}()
+
+	err = am.UnmarshalBinary(buffer)
+	if err != nil {
+		return EmptyApplicationMessage, fmt.Errorf("Error unmarshaling message type %s: %s", am.MsgType.String(), err.Error())
+	}
+	am.From = c.Remote()
+	return am, nil
+}
+
+// receiveLengthPrefixed reads a 4-byte big-endian length prefix followed by
+// exactly that many bytes of payload, using io.ReadFull instead of relying
+// on a short read to signal end-of-message - a short read on a TCP stream
+// just means the kernel handed us less than we asked for, not that the
+// message is over.
+func (c *TcpConn) receiveLengthPrefixed() ([]byte, error) {
+	header := make([]byte, lengthHeaderSize)
+	if _, err := io.ReadFull(c.rx, header); err != nil {
+		return nil, handleError(err)
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("Message of size %d bytes exceeds max message size %d bytes", length, maxMessageSize)
+	}
+	buffer := make([]byte, length)
+	if _, err := io.ReadFull(c.rx, buffer); err != nil {
+		return nil, handleError(err)
+	}
+	return buffer, nil
+}
+
+// receiveRaw is the legacy framing kept only for SetWireVersion(true): it
+// reads until a short read, which is not actually a reliable end-of-message
+// signal on TCP and can truncate or coalesce messages. Do not use this for
+// new deployments.
+func (c *TcpConn) receiveRaw() ([]byte, error) {
 	bufferSize := 4096
 	b := make([]byte, bufferSize)
 	var buffer bytes.Buffer
-	var err error
-	//c.Conn.SetReadDeadline(time.Now().Add(timeOut))
 	for {
-		n, err := c.Conn.Read(b)
+		n, err := c.rx.Read(b)
 		b = b[:n]
 		buffer.Write(b)
 		if err != nil {
-			e := handleError(err)
-			return EmptyApplicationMessage, e
+			return nil, handleError(err)
 		}
 		if n < bufferSize {
-			// read all data
 			break
 		}
 	}
-	defer func() {
-		if e := recover(); e != nil {
-			fmt.Printf("Error Unmarshalling %s: %dbytes : %v\n", am.MsgType, len(buffer.Bytes()), e)
-		}
-	}()
-
-	err = am.UnmarshalBinary(buffer.Bytes())
-	if err != nil {
-		return EmptyApplicationMessage, fmt.Errorf("Error unmarshaling message type %s: %s", am.MsgType.String(), err.Error())
-	}
-	am.From = c.Remote()
-	return am, nil
+	return buffer.Bytes(), nil
 }
 
 // Send will convert the Protocolmessage into an ApplicationMessage
@@ -287,7 +425,13 @@ func (c *TcpConn) Send(ctx context.Context, obj ProtocolMessage) error {
 	}
 
 	c.Conn.SetWriteDeadline(time.Now().Add(timeOut))
-	_, err = c.Conn.Write(b)
+	if wireVersion == wireVersionRaw {
+		_, err = c.tx.Write(b)
+	} else {
+		header := make([]byte, lengthHeaderSize)
+		binary.BigEndian.PutUint32(header, uint32(len(b)))
+		_, err = c.tx.Write(append(header, b...))
+	}
 	if err != nil {
 		return handleError(err)
 	}
@@ -393,8 +537,11 @@ func NewSecureTcpHost(private abstract.Secret, id Identity) *SecureTcpHost {
 	}
 }
 
-// Listen will try each addresses it the host identity.
-// Returns an error if it can listen on any address
+// Listen binds every address in the host identity concurrently - a host
+// advertising both an IPv4 and an IPv6 endpoint, say, is reachable on
+// either one. It only returns an error if every address failed to bind;
+// errors for addresses that did fail are aggregated into that error.
+// Otherwise it blocks until the host is closed.
 func (st *SecureTcpHost) Listen(fn func(SecureConn)) error {
 	receiver := func(c *TcpConn) {
 		stc := &SecureTcpConn{
@@ -403,24 +550,27 @@ func (st *SecureTcpHost) Listen(fn func(SecureConn)) error {
 		}
 		// if negociation fails we drop the connection
 		if err := stc.negotiateListen(); err != nil {
-			fmt.Println("Negociation failed")
+			stc.logger.Error("Identity negotiation failed", "err", err)
 			stc.Close()
 			return
 		}
 		go fn(stc)
 	}
-	var addr string
-	for _, addr = range st.Identity.Addresses {
+	var errs []string
+	bound := 0
+	for _, addr := range st.Identity.Addresses {
 		st.workingAddress = addr
-		if err := st.TcpHost.listen(addr, receiver); err != nil {
-			// THe listening is over
-			if err == ErrClosed || err == ErrEOF {
-				return nil
-			}
-			// else that means this address dont work. lets try another one.
+		if err := st.TcpHost.bind(addr, receiver); err != nil {
+			errs = append(errs, err.Error())
+			continue
 		}
+		bound++
 	}
-	return fmt.Errorf("No address worked for listening on this host")
+	if bound == 0 {
+		return fmt.Errorf("No address worked for listening on this host: %s", strings.Join(errs, "; "))
+	}
+	<-st.TcpHost.quit
+	return nil
 }
 
 // Open will try any address that is in the identity and connect to the first
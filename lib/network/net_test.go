@@ -0,0 +1,36 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTcpHostListenOnMultipleAddresses verifies the chunk0-3 requirement
+// that a host binds every address handed to Listen/bind, and that any one
+// of them can be used to dial in: two concurrent accept() goroutines (one
+// per bound listener) must not race on TcpHost.peers.
+func TestTcpHostListenOnMultipleAddresses(t *testing.T) {
+	addrs := []string{"127.0.0.1:13851", "127.0.0.1:13852"}
+
+	server := NewTcpHost()
+	defer server.Close()
+	accepted := make(chan *TcpConn, len(addrs))
+	for _, addr := range addrs {
+		if err := server.bind(addr, func(c *TcpConn) { accepted <- c }); err != nil {
+			t.Fatalf("could not bind %s: %s", addr, err)
+		}
+	}
+
+	for _, addr := range addrs {
+		client := NewTcpHost()
+		if _, err := client.Open(addr); err != nil {
+			t.Fatalf("could not dial %s: %s", addr, err)
+		}
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+			t.Fatalf("server never accepted a connection dialed via %s", addr)
+		}
+		client.Close()
+	}
+}
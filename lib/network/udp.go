@@ -0,0 +1,531 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/protobuf"
+	"github.com/satori/go.uuid"
+)
+
+// udpMTU is a conservative guess at the path MTU. Payloads bigger than this
+// (minus the fragment header) get split across several datagrams and
+// reassembled on the receiving end.
+const udpMTU = 1400
+
+// udpHeaderSize is the size in bytes of the fragment header prepended to
+// every datagram: 4 bytes message-id, 2 bytes fragment index, 2 bytes
+// fragment count.
+const udpHeaderSize = 8
+
+// udpMaxPayload is how many bytes of the actual ApplicationMessage fit in a
+// single fragment.
+const udpMaxPayload = udpMTU - udpHeaderSize
+
+// handshakeRetry is how many times we resend a lost handshake packet before
+// giving up - UDP gives us no delivery guarantee so the identity-exchange
+// used by SecureUdpConn needs its own retransmission.
+const handshakeRetry = 5
+const handshakeTimeout = 500 * time.Millisecond
+
+// maxFragmentsPerMessage bounds how many fragments a single message may
+// claim to be split into. Without it, a peer's forged "fragment count"
+// header field (an attacker-controlled uint16, up to 65535) could make us
+// allocate an arbitrarily large parts slice for a message that never
+// actually arrives - the UDP equivalent of TcpConn's maxMessageSize. It is
+// derived from maxMessageSize at call time, rather than cached, so it
+// tracks SetMaxMessageSize; the result is also capped at 65535 since that's
+// the largest value the wire format's fragment-count field can ever hold.
+func maxFragmentsPerMessage() int {
+	n := (int(maxMessageSize)+udpMaxPayload-1)/udpMaxPayload + 1
+	if n > 65535 {
+		n = 65535
+	}
+	return n
+}
+
+// fragmentTimeout bounds how long a partially-reassembled message is kept
+// in UdpConn.fragments before it is dropped. Without it, a peer that keeps
+// starting new message IDs but never finishes any of them could grow that
+// map without bound.
+const fragmentTimeout = 30 * time.Second
+
+// packetConn is the subset of net.PacketConn that UdpHost needs. Splitting
+// it out lets tests substitute an in-memory packet conn instead of a real
+// UDP socket.
+type packetConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// UdpHost is a Host implementation using a single PacketConn and a
+// per-remote demultiplexer, instead of one TCP socket per peer.
+type UdpHost struct {
+	// the underlying packet conn, shared by every UdpConn opened or
+	// accepted by this host
+	conn packetConn
+	// peers maps a remote address to the UdpConn handling it
+	peers    map[string]*UdpConn
+	peersMut sync.Mutex
+	// the close channel used to indicate to the demux loop we want to quit
+	quit chan bool
+	// indicates wether this host is closed already or not
+	closed bool
+	// a list of constructors for en/decoding
+	constructors protobuf.Constructors
+	// called the first time a datagram is seen from a new remote, used by
+	// Listen/SecureUdpHost.Listen to trigger the per-peer handshake
+	onNewPeer func(*UdpConn)
+}
+
+// NewUdpHost returns a fresh, unbound UDP Host. Call Listen or Open to give
+// it an underlying socket.
+func NewUdpHost() *UdpHost {
+	return &UdpHost{
+		peers:        make(map[string]*UdpConn),
+		quit:         make(chan bool),
+		constructors: DefaultConstructors(Suite),
+	}
+}
+
+// Open registers "name" as a peer of this host, first binding an ephemeral
+// local UDP socket if the host has none yet; otherwise the existing socket
+// is shared. If anything went wrong, Conn will be nil.
+func (u *UdpHost) Open(name string) (Conn, error) {
+	if u.conn == nil {
+		pc, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, fmt.Errorf("Could not open udp socket: %s", err)
+		}
+		u.conn = pc
+		go u.demux()
+	}
+	raddr, err := net.ResolveUDPAddr("udp", name)
+	if err != nil {
+		return nil, fmt.Errorf("Could not resolve %s: %s", name, err)
+	}
+	// Key by the resolved address, not the literal dial string: demux()
+	// registers incoming datagrams under raddr.String() too, and for any
+	// non-numeric name (a hostname, say) the two would otherwise diverge,
+	// leaving the UdpConn returned here listening on a key nothing ever
+	// delivers to.
+	c := u.registerConn(raddr.String(), raddr)
+	return c, nil
+}
+
+// registerConn creates (or returns the existing) UdpConn for a remote
+// address, and wires it into the demultiplexer.
+func (u *UdpHost) registerConn(name string, raddr net.Addr) *UdpConn {
+	u.peersMut.Lock()
+	defer u.peersMut.Unlock()
+	if c, ok := u.peers[name]; ok {
+		return c
+	}
+	c := &UdpConn{
+		Endpoint:  name,
+		remote:    raddr,
+		host:      u,
+		recvQueue: make(chan ApplicationMessage, 10),
+		fragments: make(map[uint32]*udpReassembly),
+	}
+	u.peers[name] = c
+	return c
+}
+
+// Listen binds a UDP socket on addr and dispatches every new remote it
+// hears from to fn, as soon as its first datagram arrives (before that
+// datagram is reassembled into an ApplicationMessage).
+func (u *UdpHost) Listen(addr string, fn func(Conn)) error {
+	receiver := func(c *UdpConn) {
+		go fn(c)
+	}
+	return u.listen(addr, receiver)
+}
+
+// listen is the private counterpart of Listen that hands back the concrete
+// *UdpConn, used by SecureUdpHost so it can run its handshake before
+// exposing the connection to the caller.
+func (u *UdpHost) listen(addr string, fn func(*UdpConn)) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Error opening udp listener on address %s", addr)
+	}
+	u.conn = pc
+	seen := make(map[string]bool)
+	u.onNewPeer = func(c *UdpConn) {
+		if !seen[c.Endpoint] {
+			seen[c.Endpoint] = true
+			fn(c)
+		}
+	}
+	u.demux()
+	return nil
+}
+
+// demux reads datagrams off the shared socket and routes them to the
+// UdpConn of the remote that sent them, reassembling fragmented messages
+// along the way.
+func (u *UdpHost) demux() {
+	buf := make([]byte, udpMTU)
+	for {
+		n, raddr, err := u.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-u.quit:
+				return
+			default:
+			}
+			continue
+		}
+		name := raddr.String()
+		c := u.registerConn(name, raddr)
+		if u.onNewPeer != nil {
+			u.onNewPeer(c)
+		}
+		c.handleFragment(buf[:n])
+	}
+}
+
+// Close shuts down every UdpConn and the underlying socket.
+func (u *UdpHost) Close() error {
+	if u.closed {
+		return nil
+	}
+	u.closed = true
+	close(u.quit)
+	for _, c := range u.peers {
+		c.closed = true
+	}
+	if u.conn != nil {
+		return u.conn.Close()
+	}
+	return nil
+}
+
+// udpReassembly tracks the fragments seen so far for one in-flight message.
+type udpReassembly struct {
+	total   int
+	got     int
+	parts   [][]byte
+	started time.Time
+}
+
+// UdpConn is the Conn implementation handed out by UdpHost. Every UdpConn
+// sharing a UdpHost multiplexes over the same socket.
+type UdpConn struct {
+	// The name of the endpoint we are connected to.
+	Endpoint string
+	// the resolved remote address, ready to pass to WriteTo
+	remote net.Addr
+	// the host multiplexing datagrams for every UdpConn
+	host *UdpHost
+	// closed indicator
+	closed bool
+	// reassembled, fully-received messages waiting to be Received
+	recvQueue chan ApplicationMessage
+	// in-flight fragments, keyed by message id
+	fragMut   sync.Mutex
+	fragments map[uint32]*udpReassembly
+	lastEvict time.Time
+	// sendMut guards nextMsgID, so Send can be called from more than one
+	// goroutine on the same conn without two messages racing for the same id
+	sendMut   sync.Mutex
+	nextMsgID uint32
+}
+
+// Remote returns the address of the peer at the other end of this UdpConn.
+func (c *UdpConn) Remote() string {
+	return c.Endpoint
+}
+
+// Send fragments obj into one or more datagrams, each starting with a
+// fragment header, and writes them on the host's shared socket.
+func (c *UdpConn) Send(ctx context.Context, obj ProtocolMessage) error {
+	am, err := newApplicationMessage(obj)
+	if err != nil {
+		return fmt.Errorf("Error converting packet: %v", err)
+	}
+	b, err := am.MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("Error marshaling message: %s", err.Error())
+	}
+	return c.sendFragments(b)
+}
+
+// sendFragments splits b into udpMaxPayload-sized chunks, each prefixed by
+// an 8-byte header (msgID, fragment index, fragment count), and writes them
+// to the remote address.
+func (c *UdpConn) sendFragments(b []byte) error {
+	c.sendMut.Lock()
+	msgID := c.nextMsgID
+	c.nextMsgID++
+	c.sendMut.Unlock()
+	total := (len(b) + udpMaxPayload - 1) / udpMaxPayload
+	if total == 0 {
+		total = 1
+	}
+	for i := 0; i < total; i++ {
+		start := i * udpMaxPayload
+		end := start + udpMaxPayload
+		if end > len(b) {
+			end = len(b)
+		}
+		header := make([]byte, udpHeaderSize)
+		binary.BigEndian.PutUint32(header[0:4], msgID)
+		binary.BigEndian.PutUint16(header[4:6], uint16(i))
+		binary.BigEndian.PutUint16(header[6:8], uint16(total))
+		datagram := append(header, b[start:end]...)
+		if _, err := c.host.conn.WriteTo(datagram, c.remote); err != nil {
+			return handleError(err)
+		}
+	}
+	return nil
+}
+
+// handleFragment is called by the host's demux loop for every datagram
+// addressed to this conn. Once every fragment of a message has arrived, the
+// reassembled ApplicationMessage is decoded and queued for Receive.
+func (c *UdpConn) handleFragment(datagram []byte) {
+	if len(datagram) < udpHeaderSize {
+		return
+	}
+	msgID := binary.BigEndian.Uint32(datagram[0:4])
+	idx := binary.BigEndian.Uint16(datagram[4:6])
+	total := binary.BigEndian.Uint16(datagram[6:8])
+	payload := datagram[udpHeaderSize:]
+	if int(total) == 0 || int(total) > maxFragmentsPerMessage() || int(idx) >= int(total) {
+		return
+	}
+
+	c.fragMut.Lock()
+	c.evictStaleFragments()
+	r, ok := c.fragments[msgID]
+	if !ok {
+		r = &udpReassembly{total: int(total), parts: make([][]byte, total), started: time.Now()}
+		c.fragments[msgID] = r
+	}
+	if int(total) != r.total {
+		// peer changed its story about how many fragments this message
+		// has - drop it rather than risk an index out of the parts slice
+		c.fragMut.Unlock()
+		return
+	}
+	if r.parts[idx] == nil {
+		// datagram aliases demux's single reused read buffer, so it must be
+		// copied before being retained past this call - the next ReadFrom
+		// would otherwise silently overwrite a not-yet-complete fragment.
+		r.parts[idx] = append([]byte(nil), payload...)
+		r.got++
+	}
+	complete := r.got == r.total
+	if complete {
+		delete(c.fragments, msgID)
+	}
+	c.fragMut.Unlock()
+
+	if !complete {
+		return
+	}
+	var buf bytes.Buffer
+	for _, p := range r.parts {
+		buf.Write(p)
+	}
+	var am ApplicationMessage
+	am.Constructors = c.host.constructors
+	if err := am.UnmarshalBinary(buf.Bytes()); err != nil {
+		return
+	}
+	am.From = c.Remote()
+	select {
+	case c.recvQueue <- am:
+	default:
+		// receiver is too slow, drop the message rather than block the demux loop
+	}
+}
+
+// evictStaleFragments drops any in-flight reassembly older than
+// fragmentTimeout. It scans at most once per fragmentTimeout/2, so a steady
+// stream of datagrams doesn't pay for a full map scan on every packet.
+// Called with fragMut held.
+func (c *UdpConn) evictStaleFragments() {
+	now := time.Now()
+	if now.Sub(c.lastEvict) < fragmentTimeout/2 {
+		return
+	}
+	c.lastEvict = now
+	for id, r := range c.fragments {
+		if now.Sub(r.started) > fragmentTimeout {
+			delete(c.fragments, id)
+		}
+	}
+}
+
+// Receive blocks until a full ApplicationMessage has been reassembled, the
+// context is canceled, or the conn is closed.
+func (c *UdpConn) Receive(ctx context.Context) (ApplicationMessage, error) {
+	select {
+	case am := <-c.recvQueue:
+		return am, nil
+	case <-ctx.Done():
+		return EmptyApplicationMessage, ErrCanceled
+	case <-c.host.quit:
+		return EmptyApplicationMessage, ErrClosed
+	}
+}
+
+// Close marks this conn as closed. The underlying socket is shared with
+// every other UdpConn on this host and is only closed by UdpHost.Close.
+func (c *UdpConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// SecureUdpHost is a UdpHost augmented with an Identity, mirroring
+// SecureTcpHost but running the handshake over an unreliable transport.
+type SecureUdpHost struct {
+	*UdpHost
+	Identity Identity
+	// Private key tied to this identity
+	private abstract.Secret
+	// mapping from the identity to the names used in UdpHost
+	IdToAddr map[uuid.UUID]string
+}
+
+// NewSecureUdpHost returns a Secure UDP Host.
+func NewSecureUdpHost(private abstract.Secret, id Identity) *SecureUdpHost {
+	return &SecureUdpHost{
+		UdpHost:  NewUdpHost(),
+		Identity: id,
+		private:  private,
+		IdToAddr: make(map[uuid.UUID]string),
+	}
+}
+
+// SecureUdpConn is a UdpConn once it has exchanged Identities with its peer.
+type SecureUdpConn struct {
+	*UdpConn
+	*SecureUdpHost
+	identity Identity
+}
+
+// Identity returns the remote peer's Identity, once negotiated.
+func (sc *SecureUdpConn) Identity() Identity {
+	return sc.identity
+}
+
+// Receive is analog to UdpConn.Receive but also sets the right Identity on
+// the returned message.
+func (sc *SecureUdpConn) Receive(ctx context.Context) (ApplicationMessage, error) {
+	nm, err := sc.UdpConn.Receive(ctx)
+	nm.Identity = sc.identity
+	return nm, err
+}
+
+// negotiateDTLS exchanges Identities over an unreliable conn: it resends its
+// own Identity every handshakeTimeout until it has also received the peer's,
+// giving up after handshakeRetry attempts. This is the DTLS-style
+// handshake: no transport-level reliability is assumed, so the
+// identity-exchange itself has to retransmit.
+func (sc *SecureUdpConn) negotiateDTLS(ctx context.Context) error {
+	type result struct {
+		am  ApplicationMessage
+		err error
+	}
+	received := make(chan result, 1)
+	go func() {
+		am, err := sc.UdpConn.Receive(ctx)
+		received <- result{am, err}
+	}()
+
+	for attempt := 0; attempt < handshakeRetry; attempt++ {
+		if err := sc.UdpConn.Send(ctx, &sc.SecureUdpHost.Identity); err != nil {
+			return fmt.Errorf("Error sending identity during DTLS handshake: %s", err)
+		}
+		select {
+		case res := <-received:
+			if res.err != nil {
+				return fmt.Errorf("Error receiving identity during DTLS handshake: %s", res.err)
+			}
+			if res.am.MsgType != IdentityType {
+				return fmt.Errorf("Received wrong type during DTLS handshake %s", res.am.MsgType.String())
+			}
+			sc.identity = res.am.Msg.(Identity)
+			return nil
+		case <-time.After(handshakeTimeout):
+			// peer may not have received our Identity yet - resend
+			continue
+		}
+	}
+	return fmt.Errorf("DTLS handshake with %s timed out after %d attempts", sc.Remote(), handshakeRetry)
+}
+
+// Listen accepts incoming datagrams on the host Identity's first address
+// and, for every new remote, runs the DTLS-style identity handshake before
+// handing the SecureUdpConn to fn.
+func (su *SecureUdpHost) Listen(fn func(SecureConn)) error {
+	receiver := func(c *UdpConn) {
+		// receiver is called from demux, which has to keep running to
+		// deliver the peer's Identity, so the handshake must not block it
+		go func() {
+			suc := &SecureUdpConn{
+				UdpConn:       c,
+				SecureUdpHost: su,
+			}
+			if err := suc.negotiateDTLS(context.TODO()); err != nil {
+				suc.Close()
+				return
+			}
+			fn(suc)
+		}()
+	}
+	return su.UdpHost.listen(su.Identity.First(), receiver)
+}
+
+// Open dials the first reachable address in id and runs the DTLS-style
+// handshake, verifying the remote answers with the expected Identity.
+func (su *SecureUdpHost) Open(id Identity) (SecureConn, error) {
+	var errs []string
+	for _, addr := range id.Addresses {
+		c, err := su.UdpHost.Open(addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		suc := &SecureUdpConn{
+			UdpConn:       c.(*UdpConn),
+			SecureUdpHost: su,
+		}
+		if err := suc.negotiateDTLS(context.TODO()); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if suc.identity.Id != id.Id {
+			return nil, fmt.Errorf("Identity received during DTLS handshake is wrong. WARNING")
+		}
+		return suc, nil
+	}
+	return nil, fmt.Errorf("Could not connect to any address tied to this identity: %s", strings.Join(errs, "; "))
+}
+
+// NewHost builds a SecureHost for the requested transport kind, so callers
+// (like the simulation main) can pick "tcp" or "udp" from configuration
+// instead of hard-coding NewSecureTcpHost. It is a thin convenience wrapper
+// around NewNetworkAdapter and accepts every kind it does, "inproc"
+// included.
+func NewHost(kind string, private abstract.Secret, id Identity) (SecureHost, error) {
+	adapter, err := NewNetworkAdapter(kind)
+	if err != nil {
+		return nil, err
+	}
+	return adapter.NewHost(private, id)
+}
@@ -0,0 +1,174 @@
+package network
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/dedis/crypto/config"
+)
+
+// TestUdpConnReassembly verifies that a message split across several
+// fragments by sendFragments is reassembled correctly even when the
+// fragments arrive out of order, the chunk0-1 behavior the forged-header
+// guard below protects.
+func TestUdpConnReassembly(t *testing.T) {
+	senderHost := &UdpHost{
+		conn:         &captureConn{},
+		peers:        make(map[string]*UdpConn),
+		quit:         make(chan bool),
+		constructors: DefaultConstructors(Suite),
+	}
+	sender := senderHost.registerConn("receiver", &net.UDPAddr{})
+
+	kp := config.NewKeyPair(Suite)
+	// the long second address pushes the marshalled Identity well past
+	// udpMaxPayload, so it has to be split into several fragments
+	id := NewIdentity(kp.Public, "tcp://127.0.0.1:7000", strings.Repeat("x", 2*udpMaxPayload))
+	if err := sender.Send(context.TODO(), id); err != nil {
+		t.Fatalf("could not send: %s", err)
+	}
+
+	datagrams := senderHost.conn.(*captureConn).written
+	if len(datagrams) < 2 {
+		t.Fatalf("expected the Identity to be split into several fragments, got %d", len(datagrams))
+	}
+
+	receiver := &UdpConn{
+		host:      &UdpHost{constructors: DefaultConstructors(Suite)},
+		fragments: make(map[uint32]*udpReassembly),
+		recvQueue: make(chan ApplicationMessage, 1),
+	}
+	rand.Shuffle(len(datagrams), func(i, j int) { datagrams[i], datagrams[j] = datagrams[j], datagrams[i] })
+	for _, d := range datagrams {
+		receiver.handleFragment(d)
+	}
+
+	select {
+	case am := <-receiver.recvQueue:
+		got, ok := am.Msg.(Identity)
+		if !ok || got.Id != id.Id {
+			t.Fatalf("reassembled message doesn't match what was sent")
+		}
+	default:
+		t.Fatalf("message was never reassembled")
+	}
+}
+
+// TestUdpConnReassemblyReusedBuffer drives fragments through handleFragment
+// the way demux actually does: one buffer, reused and overwritten by every
+// read. A prior version of handleFragment stored datagram[udpHeaderSize:]
+// (a slice aliasing that buffer) directly into r.parts, so an earlier
+// fragment's bytes were silently clobbered by the next read before
+// reassembly finished; this test fails on that version instead of only
+// exercising the independently-allocated-slices path.
+func TestUdpConnReassemblyReusedBuffer(t *testing.T) {
+	senderHost := &UdpHost{
+		conn:         &captureConn{},
+		peers:        make(map[string]*UdpConn),
+		quit:         make(chan bool),
+		constructors: DefaultConstructors(Suite),
+	}
+	sender := senderHost.registerConn("receiver", &net.UDPAddr{})
+
+	kp := config.NewKeyPair(Suite)
+	// the long second address forces several fragments, see TestUdpConnReassembly
+	id := NewIdentity(kp.Public, "tcp://127.0.0.1:7000", strings.Repeat("x", 2*udpMaxPayload))
+	if err := sender.Send(context.TODO(), id); err != nil {
+		t.Fatalf("could not send: %s", err)
+	}
+
+	datagrams := senderHost.conn.(*captureConn).written
+	if len(datagrams) < 2 {
+		t.Fatalf("expected the Identity to be split into several fragments, got %d", len(datagrams))
+	}
+
+	receiver := &UdpConn{
+		host:      &UdpHost{constructors: DefaultConstructors(Suite)},
+		fragments: make(map[uint32]*udpReassembly),
+		recvQueue: make(chan ApplicationMessage, 1),
+	}
+	buf := make([]byte, udpMTU)
+	for _, d := range datagrams {
+		n := copy(buf, d)
+		receiver.handleFragment(buf[:n])
+	}
+
+	select {
+	case am := <-receiver.recvQueue:
+		got, ok := am.Msg.(Identity)
+		if !ok || got.Id != id.Id {
+			t.Fatalf("reassembled message doesn't match what was sent - a fragment was clobbered by buffer reuse")
+		}
+	default:
+		t.Fatalf("message was never reassembled")
+	}
+}
+
+// TestUdpConnHandleFragmentRejectsForgedHeader verifies the bounds check
+// added alongside maxFragmentsPerMessage: a forged fragment count of 0, or a
+// fragment index past the claimed count, must be dropped instead of
+// panicking on a zero-length or out-of-range parts slice.
+func TestUdpConnHandleFragmentRejectsForgedHeader(t *testing.T) {
+	c := &UdpConn{fragments: make(map[uint32]*udpReassembly)}
+	header := func(idx, total uint16) []byte {
+		h := make([]byte, udpHeaderSize)
+		binary.BigEndian.PutUint32(h[0:4], 1)
+		binary.BigEndian.PutUint16(h[4:6], idx)
+		binary.BigEndian.PutUint16(h[6:8], total)
+		return h
+	}
+
+	c.handleFragment(header(0, 0))
+	c.handleFragment(header(5, 2))
+
+	if len(c.fragments) != 0 {
+		t.Fatalf("forged fragment headers should never create a reassembly entry, got %d", len(c.fragments))
+	}
+}
+
+// TestUdpConnEvictsStaleFragments verifies a partially-received message is
+// dropped once it's older than fragmentTimeout, rather than being kept
+// around forever by a peer that never sends the rest of it.
+func TestUdpConnEvictsStaleFragments(t *testing.T) {
+	c := &UdpConn{fragments: make(map[uint32]*udpReassembly)}
+	c.fragments[1] = &udpReassembly{total: 2, parts: make([][]byte, 2), started: time.Now().Add(-2 * fragmentTimeout)}
+	c.lastEvict = time.Now().Add(-fragmentTimeout)
+
+	c.fragMut.Lock()
+	c.evictStaleFragments()
+	c.fragMut.Unlock()
+
+	if len(c.fragments) != 0 {
+		t.Fatalf("expected the stale reassembly to be evicted, got %d entries", len(c.fragments))
+	}
+}
+
+// captureConn is a packetConn that records every datagram written to it
+// instead of putting it on the wire, so tests can exercise Send/handleFragment
+// without opening a real UDP socket.
+type captureConn struct {
+	written [][]byte
+}
+
+// ReadFrom is never exercised by these tests: fragments are fed to
+// handleFragment directly instead of going through demux.
+func (c *captureConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	return 0, nil, net.ErrClosed
+}
+
+func (c *captureConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	cp := make([]byte, len(b))
+	copy(cp, b)
+	c.written = append(c.written, cp)
+	return len(b), nil
+}
+
+func (c *captureConn) Close() error { return nil }
+
+func (c *captureConn) LocalAddr() net.Addr { return &net.UDPAddr{} }
@@ -0,0 +1,192 @@
+// Package log is a small structured logging helper used throughout
+// cothority. It started as a handful of package-level Lvl1..Lvl5 functions
+// that concatenated their arguments with fmt.Sprintln; this still works
+// exactly as before, but on top of it you can now build a Logger that
+// carries a fixed set of key/value context (a Conode id, a protocol name)
+// and prepends it to every record it emits, human-readable or as JSON.
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DebugVisible is the highest Lvl* level that gets printed. Set it with
+// SetDebugVisible.
+var DebugVisible = 1
+
+// FormatHuman and FormatJSON select how records are rendered: "human" (the
+// default) or "json", selectable at runtime via the simulator's "-logfmt"
+// flag.
+const (
+	FormatHuman = "human"
+	FormatJSON  = "json"
+)
+
+var formatMu sync.Mutex
+var format = FormatHuman
+
+// SetFormat switches every Logger's output between human-readable and JSON
+// records. Researchers grepping thousands of Conode logs during a
+// simulation can pass "-logfmt json" to get one parseable object per line.
+func SetFormat(f string) {
+	formatMu.Lock()
+	defer formatMu.Unlock()
+	format = f
+}
+
+// SetDebugVisible sets the global debug level; calls to Lvl{n} with n above
+// this level are silently dropped.
+func SetDebugVisible(n int) {
+	DebugVisible = n
+}
+
+// root is the package-level Logger backing the legacy Lvl1..Lvl5/Error/Fatal
+// functions, kept for backward compatibility with existing call sites.
+var root = New()
+
+// Logger carries a fixed list of key/value pairs that get prepended to
+// every record it emits. Loggers are derived with New, which returns a
+// child that adds to - rather than replaces - its parent's context, mirroring
+// the way go-ethereum's p2p logger scopes context down to a single peer or
+// protocol run.
+type Logger struct {
+	ctx []interface{}
+}
+
+// New returns a root Logger, or - called on an existing Logger - a child
+// that prepends its own keysAndValues to every record it emits, on top of
+// its parent's. keysAndValues must be an even-length list of alternating
+// keys and values, e.g. New("conode", id, "protocol", simul).
+func New(keysAndValues ...interface{}) *Logger {
+	return &Logger{ctx: keysAndValues}
+}
+
+// New derives a child Logger that adds keysAndValues on top of l's own
+// context.
+func (l *Logger) New(keysAndValues ...interface{}) *Logger {
+	ctx := make([]interface{}, 0, len(l.ctx)+len(keysAndValues))
+	ctx = append(ctx, l.ctx...)
+	ctx = append(ctx, keysAndValues...)
+	return &Logger{ctx: ctx}
+}
+
+func (l *Logger) log(level, msg string, keysAndValues []interface{}) {
+	ctx := make([]interface{}, 0, len(l.ctx)+len(keysAndValues))
+	ctx = append(ctx, l.ctx...)
+	ctx = append(ctx, keysAndValues...)
+
+	formatMu.Lock()
+	f := format
+	formatMu.Unlock()
+
+	if f == FormatJSON {
+		rec := map[string]interface{}{
+			"t":     time.Now().Format(time.RFC3339Nano),
+			"level": level,
+			"msg":   msg,
+		}
+		for i := 0; i+1 < len(ctx); i += 2 {
+			if k, ok := ctx[i].(string); ok {
+				rec[k] = ctx[i+1]
+			}
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		fmt.Println(string(b))
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(strings.ToUpper(level))
+	sb.WriteString(": ")
+	sb.WriteString(msg)
+	for i := 0; i+1 < len(ctx); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", ctx[i], ctx[i+1])
+	}
+	fmt.Println(sb.String())
+}
+
+// Trace logs msg at the most verbose level.
+func (l *Logger) Trace(msg string, keysAndValues ...interface{}) {
+	if DebugVisible < 5 {
+		return
+	}
+	l.log("trace", msg, keysAndValues)
+}
+
+// Debug logs msg with the given key/value context.
+func (l *Logger) Debug(msg string, keysAndValues ...interface{}) {
+	if DebugVisible < 3 {
+		return
+	}
+	l.log("debug", msg, keysAndValues)
+}
+
+// Info logs msg with the given key/value context.
+func (l *Logger) Info(msg string, keysAndValues ...interface{}) {
+	if DebugVisible < 1 {
+		return
+	}
+	l.log("info", msg, keysAndValues)
+}
+
+// Warn logs msg with the given key/value context.
+func (l *Logger) Warn(msg string, keysAndValues ...interface{}) {
+	l.log("warn", msg, keysAndValues)
+}
+
+// Error logs msg with the given key/value context.
+func (l *Logger) Error(msg string, keysAndValues ...interface{}) {
+	l.log("error", msg, keysAndValues)
+}
+
+// Fatal logs msg with the given key/value context, then exits the process.
+func (l *Logger) Fatal(msg string, keysAndValues ...interface{}) {
+	l.log("fatal", msg, keysAndValues)
+	os.Exit(1)
+}
+
+// The functions below are the legacy, ad-hoc-concatenation API most of the
+// codebase still uses; they all delegate to the package-level root Logger
+// so existing call sites keep working unchanged.
+
+// Lvl1 prints args if DebugVisible >= 1.
+func Lvl1(args ...interface{}) { lvl(1, args...) }
+
+// Lvl2 prints args if DebugVisible >= 2.
+func Lvl2(args ...interface{}) { lvl(2, args...) }
+
+// Lvl3 prints args if DebugVisible >= 3.
+func Lvl3(args ...interface{}) { lvl(3, args...) }
+
+// Lvl4 prints args if DebugVisible >= 4.
+func Lvl4(args ...interface{}) { lvl(4, args...) }
+
+// Lvl5 prints args if DebugVisible >= 5.
+func Lvl5(args ...interface{}) { lvl(5, args...) }
+
+func lvl(n int, args ...interface{}) {
+	if DebugVisible < n {
+		return
+	}
+	root.log(fmt.Sprintf("lvl%d", n), strings.TrimSpace(fmt.Sprintln(args...)), nil)
+}
+
+// Error prints args unconditionally.
+func Error(args ...interface{}) {
+	root.log("error", strings.TrimSpace(fmt.Sprintln(args...)), nil)
+}
+
+// Fatal prints args unconditionally, then exits the process.
+func Fatal(args ...interface{}) {
+	root.log("fatal", strings.TrimSpace(fmt.Sprintln(args...)), nil)
+	os.Exit(1)
+}
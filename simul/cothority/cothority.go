@@ -31,6 +31,16 @@ var simul string
 
 var debugVisible int
 
+// adapter picks which network.NetworkAdapter backs every Conode in this
+// simulation: "tcp" opens real sockets, "inproc" keeps everything in this
+// process over Go channels so thousands of Conodes can run on one laptop.
+var adapter string
+
+// logfmt selects log.FormatHuman or log.FormatJSON for every Logger derived
+// below, so a large simulation's output can be piped through jq instead of
+// grepped by eye.
+var logfmt string
+
 // Initialize before 'init' so we can directly use the fields as parameters
 // to 'Flag'
 func init() {
@@ -38,24 +48,28 @@ func init() {
 	flag.StringVar(&simul, "simul", "", "start simulating that protocol")
 	flag.StringVar(&monitorAddress, "monitor", "", "remote monitor")
 	flag.IntVar(&debugVisible, "debug", 1, "verbosity: 0-5")
+	flag.StringVar(&adapter, "adapter", "tcp", "network adapter to use: tcp or inproc")
+	flag.StringVar(&logfmt, "logfmt", log.FormatHuman, "log output format: human or json")
 }
 
 // Main starts the host and will setup the protocol.
 func main() {
 	flag.Parse()
 	log.SetDebugVisible(debugVisible)
-	log.Lvl3("Flags are:", hostAddress, simul, log.DebugVisible, monitorAddress)
+	log.SetFormat(logfmt)
+	logger := log.New("conode", hostAddress, "protocol", simul)
+	logger.Trace("Flags are set", "debug", log.DebugVisible, "monitor", monitorAddress, "adapter", adapter)
 
-	scs, err := sda.LoadSimulationConfig(".", hostAddress)
+	scs, err := sda.LoadSimulationConfig(".", hostAddress, adapter)
 	measures := make([]*monitor.CounterIOMeasure, len(scs))
 	if err != nil {
 		// We probably are not needed
-		log.Lvl2(err, hostAddress)
+		logger.Debug("Not part of this simulation", "err", err)
 		return
 	}
 	if monitorAddress != "" {
 		if err := monitor.ConnectSink(monitorAddress); err != nil {
-			log.Error("Couldn't connect monitor to sink:", err)
+			logger.Error("Couldn't connect monitor to sink", "err", err)
 		}
 	}
 	sims := make([]sda.Simulation, len(scs))
@@ -67,41 +81,42 @@ func main() {
 	for i, sc := range scs {
 		// Starting all hosts for that server
 		host := sc.Conode
+		hostLogger := logger.New("conode", host.ServerIdentity.ID)
 		measures[i] = monitor.NewCounterIOMeasure("bandwidth", host)
-		log.Lvl3(hostAddress, "Starting host", host.ServerIdentity.Address)
+		hostLogger.Trace("Starting host", "address", host.ServerIdentity.Address)
 		// Launch a host and notifies when it's done
 
 		wg.Add(1)
-		go func(h *sda.Conode, m monitor.Measure) {
+		go func(h *sda.Conode, m monitor.Measure, hl *log.Logger) {
 			ready <- true
 			defer wg.Done()
 			h.Start()
 			// record bandwidth
 			m.Record()
-			log.Lvl3(hostAddress, "Simulation closed host", h.ServerIdentity)
-		}(host, measures[i])
+			hl.Trace("Simulation closed host")
+		}(host, measures[i], hostLogger)
 		// wait to be sure the goroutine started
 		<-ready
 
 		sim, err := sda.NewSimulation(simul, sc.Config)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("Couldn't create simulation", "err", err)
 		}
 		err = sim.Node(sc)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("Couldn't set up simulation node", "err", err)
 		}
 		sims[i] = sim
 		if host.ServerIdentity.ID == sc.Tree.Root.ServerIdentity.ID {
-			log.Lvl2(hostAddress, "is root-node, will start protocol")
+			hostLogger.Debug("Is root-node, will start protocol")
 			rootSim = sim
 			rootSC = sc
 		}
 	}
 	if rootSim != nil {
 		// If this cothority has the root-host, it will start the simulation
-		log.Lvl2("Starting protocol", simul, "on host", rootSC.Conode.ServerIdentity.Address)
-		//log.Lvl5("Tree is", rootSC.Tree.Dump())
+		rootLogger := logger.New("conode", rootSC.Conode.ServerIdentity.ID)
+		rootLogger.Debug("Starting protocol", "address", rootSC.Conode.ServerIdentity.Address)
 
 		// First count the number of available children
 		childrenWait := monitor.NewTimeMeasure("ChildrenWait")
@@ -112,38 +127,38 @@ func main() {
 		for wait {
 			p, err := rootSC.Overlay.CreateProtocolSDA("Count", rootSC.Tree)
 			if err != nil {
-				log.Fatal(err)
+				logger.Fatal("Couldn't create Count protocol", "err", err)
 			}
 			proto := p.(*manage.ProtocolCount)
 			proto.SetTimeout(timeout)
 			proto.Start()
-			log.Lvl1("Started counting children with timeout of", timeout)
+			rootLogger.Info("Started counting children", "timeout", timeout)
 			select {
 			case count := <-proto.Count:
 				if count == rootSC.Tree.Size() {
-					log.Lvl1("Found all", count, "children")
+					rootLogger.Info("Found all children", "count", count)
 					wait = false
 				} else {
-					log.Lvl1("Found only", count, "children, counting again")
+					rootLogger.Info("Found only some children, counting again", "count", count)
 				}
 			}
 			// Double the timeout and try again if not successful.
 			timeout *= 2
 		}
 		childrenWait.Record()
-		log.Lvl1("Starting new node", simul)
+		rootLogger.Info("Starting new node")
 		measureNet := monitor.NewCounterIOMeasure("bandwidth_root", rootSC.Conode)
 		err := rootSim.Run(rootSC)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("Simulation run failed", "err", err)
 		}
 		measureNet.Record()
 
 		// Test if all ServerIdentities are used in the tree, else we'll run into
 		// troubles with CloseAll
 		if !rootSC.Tree.UsesList() {
-			log.Error("The tree doesn't use all ServerIdentities from the list!\n" +
-				"This means that the CloseAll will fail and the experiment never ends!")
+			rootLogger.Error("The tree doesn't use all ServerIdentities from the list!" +
+				" This means that the CloseAll will fail and the experiment never ends!")
 		}
 		closeTree := rootSC.Tree
 		if rootSC.GetSingleHost() {
@@ -151,19 +166,19 @@ func main() {
 			// entity only once, whereas rootSC.Tree will have the same
 			// entity at different TreeNodes, which makes it difficult to
 			// correctly close everything.
-			log.Lvl2("Making new root-tree for SingleHost config")
+			rootLogger.Debug("Making new root-tree for SingleHost config")
 			closeTree = rootSC.Roster.GenerateBinaryTree()
 			rootSC.Overlay.RegisterTree(closeTree)
 		}
 		pi, err := rootSC.Overlay.CreateProtocolSDA("CloseAll", closeTree)
 		pi.Start()
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("Couldn't create CloseAll protocol", "err", err)
 		}
 	}
 
-	log.Lvl3(hostAddress, scs[0].Conode.ServerIdentity, "is waiting for all hosts to close")
+	logger.Trace("Waiting for all hosts to close", "conode", scs[0].Conode.ServerIdentity.ID)
 	wg.Wait()
-	log.Lvl2(hostAddress, "has all hosts closed")
+	logger.Debug("All hosts closed")
 	monitor.EndAndCleanup()
 }